@@ -0,0 +1,157 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/api/compute/v1"
+)
+
+// OperationScope describes the resource scope a GCE operation was issued
+// against, which determines which *Operations.Get call is used to refresh
+// its status.
+type OperationScope string
+
+const (
+	OperationGlobal OperationScope = "global"
+	OperationRegion OperationScope = "region"
+	OperationZone   OperationScope = "zone"
+)
+
+// OperationWaiter polls a GCE operation until it reaches a terminal state,
+// retrying transient errors with exponential backoff instead of failing
+// the reconcile on the first hiccup.
+type OperationWaiter struct {
+	Compute *compute.Service
+	Project string
+
+	// InitialInterval is the delay between the first poll (made at once)
+	// and the second; later delays double from it. Defaults to 1s.
+	InitialInterval time.Duration
+	// MaxInterval caps the backoff between polls. Defaults to 15s.
+	MaxInterval time.Duration
+	// MaxTimeout is the total time to wait before giving up. Defaults to 10m.
+	MaxTimeout time.Duration
+}
+
+// NewOperationWaiter builds an OperationWaiter with the package defaults.
+func NewOperationWaiter(compute *compute.Service, project string) *OperationWaiter {
+	return &OperationWaiter{
+		Compute:         compute,
+		Project:         project,
+		InitialInterval: 1 * time.Second,
+		MaxInterval:     15 * time.Second,
+		MaxTimeout:      10 * time.Minute,
+	}
+}
+
+// scopeForOperation determines the scope of an operation from the fields
+// the compute API populates on it.
+func scopeForOperation(op *compute.Operation) OperationScope {
+	switch {
+	case op.Zone != "":
+		return OperationZone
+	case op.Region != "":
+		return OperationRegion
+	default:
+		return OperationGlobal
+	}
+}
+
+func (w *OperationWaiter) refresh(op *compute.Operation) (*compute.Operation, error) {
+	switch scopeForOperation(op) {
+	case OperationZone:
+		return w.Compute.ZoneOperations.Get(w.Project, lastComponent(op.Zone), op.Name).Do()
+	case OperationRegion:
+		return w.Compute.RegionOperations.Get(w.Project, lastComponent(op.Region), op.Name).Do()
+	default:
+		return w.Compute.GlobalOperations.Get(w.Project, op.Name).Do()
+	}
+}
+
+// Wait blocks until op completes, the context is cancelled, or MaxTimeout
+// elapses. Errors fetching operation status are treated as transient and
+// retried rather than returned immediately.
+func (w *OperationWaiter) Wait(ctx context.Context, op *compute.Operation) error {
+	interval := w.InitialInterval
+	if interval <= 0 {
+		interval = 1 * time.Second
+	}
+	maxInterval := w.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = 15 * time.Second
+	}
+	maxTimeout := w.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = 10 * time.Minute
+	}
+	deadline := time.Now().Add(maxTimeout)
+
+	for {
+		status, err := w.refresh(op)
+		if err != nil {
+			glog.V(4).Infof("error fetching status of operation %q (will retry): %v", op.Name, err)
+		} else {
+			switch status.Status {
+			case "DONE":
+				return operationResultError(status)
+			case "PENDING", "RUNNING":
+				glog.V(4).Infof("operation %q status=%v", op.Name, status.Status)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for operation %q to complete", op.Name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval = nextInterval(interval, maxInterval)
+	}
+}
+
+// nextInterval doubles the poll interval, capped at max.
+func nextInterval(current, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+func operationResultError(status *compute.Operation) error {
+	if status.Error != nil {
+		for _, e := range status.Error.Errors {
+			glog.Warningf("operation failed with error: %v", e)
+		}
+		return fmt.Errorf("operation failed: %v", status.Error.Errors[0].Message)
+	}
+
+	if status.Warnings != nil {
+		glog.Warningf("operation completed with warnings: %v", status.Warnings)
+	}
+
+	return nil
+}
+
+// lastComponent returns the last path segment of a GCE resource URL, e.g.
+// ".../zones/us-central1-a" -> "us-central1-a".
+func lastComponent(s string) string {
+	lastSlash := -1
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == '/' {
+			lastSlash = i
+			break
+		}
+	}
+	if lastSlash == -1 {
+		return s
+	}
+	return s[lastSlash+1:]
+}
@@ -0,0 +1,93 @@
+package gce
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestScopeForOperation(t *testing.T) {
+	grid := []struct {
+		op    *compute.Operation
+		scope OperationScope
+	}{
+		{&compute.Operation{Zone: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a"}, OperationZone},
+		{&compute.Operation{Region: "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1"}, OperationRegion},
+		{&compute.Operation{}, OperationGlobal},
+		// Zone takes priority if (improbably) both are set.
+		{&compute.Operation{Zone: "zones/us-central1-a", Region: "regions/us-central1"}, OperationZone},
+	}
+
+	for _, g := range grid {
+		if got := scopeForOperation(g.op); got != g.scope {
+			t.Errorf("scopeForOperation(%+v) = %v, want %v", g.op, got, g.scope)
+		}
+	}
+}
+
+func TestOperationResultError(t *testing.T) {
+	grid := []struct {
+		name    string
+		status  *compute.Operation
+		wantErr bool
+	}{
+		{"no error or warnings", &compute.Operation{Status: "DONE"}, false},
+		{"warnings only", &compute.Operation{Status: "DONE", Warnings: []*compute.OperationWarnings{{Message: "heads up"}}}, false},
+		{
+			"operation error",
+			&compute.Operation{
+				Status: "DONE",
+				Error: &compute.OperationError{
+					Errors: []*compute.OperationErrorErrors{{Message: "quota exceeded"}},
+				},
+			},
+			true,
+		},
+	}
+
+	for _, g := range grid {
+		err := operationResultError(g.status)
+		if g.wantErr && err == nil {
+			t.Errorf("%s: expected an error, got nil", g.name)
+		}
+		if !g.wantErr && err != nil {
+			t.Errorf("%s: expected no error, got %v", g.name, err)
+		}
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+	grid := []struct {
+		current time.Duration
+		max     time.Duration
+		want    time.Duration
+	}{
+		{1 * time.Second, 15 * time.Second, 2 * time.Second},
+		{8 * time.Second, 15 * time.Second, 15 * time.Second},
+		{15 * time.Second, 15 * time.Second, 15 * time.Second},
+	}
+
+	for _, g := range grid {
+		if got := nextInterval(g.current, g.max); got != g.want {
+			t.Errorf("nextInterval(%v, %v) = %v, want %v", g.current, g.max, got, g.want)
+		}
+	}
+}
+
+func TestLastComponent(t *testing.T) {
+	grid := []struct {
+		url  string
+		want string
+	}{
+		{"https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a", "us-central1-a"},
+		{"us-central1-a", "us-central1-a"},
+		{"", ""},
+	}
+
+	for _, g := range grid {
+		if got := lastComponent(g.url); got != g.want {
+			t.Errorf("lastComponent(%q) = %q, want %q", g.url, got, g.want)
+		}
+	}
+}
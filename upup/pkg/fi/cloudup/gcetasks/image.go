@@ -0,0 +1,94 @@
+package gcetasks
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+	"k8s.io/kops/upup/pkg/fi/cloudup/gce"
+)
+
+// imageAliases maps the short OS names accepted in a cluster spec to the
+// GCE project that publishes their public images, mirroring the aliases
+// recognized by `gcloud compute instances create --image-family` and the
+// Terraform google provider.
+var imageAliases = map[string]string{
+	"debian":   "debian-cloud",
+	"ubuntu":   "ubuntu-os-cloud",
+	"coreos":   "coreos-cloud",
+	"centos":   "centos-cloud",
+	"rhel":     "rhel-cloud",
+	"sles":     "suse-cloud",
+	"opensuse": "opensuse-cloud",
+}
+
+// imageDefaultFamilies gives the image family to use for a bare OS alias
+// (e.g. "debian" rather than "debian/family/debian-9").
+var imageDefaultFamilies = map[string]string{
+	"debian":   "debian-9",
+	"ubuntu":   "ubuntu-1604-lts",
+	"coreos":   "coreos-stable",
+	"centos":   "centos-7",
+	"rhel":     "rhel-7",
+	"sles":     "sles-12",
+	"opensuse": "opensuse-42",
+}
+
+// canonicalizeImageSpec expands a user-supplied image spec into an
+// explicit project and image (or "family/name") reference, without making
+// any API calls. Accepted forms:
+//
+//	"name"                         -> defaultProject / name
+//	"project/name"                 -> project / name
+//	"project/family/family-name"   -> project / family/family-name
+//	"family/family-name"           -> defaultProject / family/family-name
+//	"debian" (or other OS alias)   -> debian-cloud / family/debian-9
+//	"debian/name"                  -> debian-cloud / name
+func canonicalizeImageSpec(defaultProject, nameSpec string) (project string, name string) {
+	if hostingProject, ok := imageAliases[nameSpec]; ok {
+		return hostingProject, "family/" + imageDefaultFamilies[nameSpec]
+	}
+
+	tokens := strings.SplitN(nameSpec, "/", 2)
+	if len(tokens) == 1 {
+		return defaultProject, tokens[0]
+	}
+
+	// "family/family-name", with no project component, names a family in
+	// defaultProject - it must be checked before the generic two-token
+	// split below, which would otherwise treat "family" as a (bogus)
+	// project name.
+	if tokens[0] == "family" {
+		return defaultProject, nameSpec
+	}
+
+	if hostingProject, ok := imageAliases[tokens[0]]; ok {
+		return hostingProject, tokens[1]
+	}
+
+	return tokens[0], tokens[1]
+}
+
+// ResolveImage resolves an image spec from a cluster manifest (a bare
+// image name, a "project/name" reference, a "family/name" or
+// "project/family/name" reference, or one of the well-known OS aliases)
+// to the concrete compute.Image it names, querying GetFromFamily when a
+// family is referenced so callers always get a pinned image.
+func ResolveImage(cloud *gce.GCECloud, nameSpec string) (*compute.Image, error) {
+	project, name := canonicalizeImageSpec(cloud.Project, nameSpec)
+
+	if strings.HasPrefix(name, "family/") {
+		family := strings.TrimPrefix(name, "family/")
+		image, err := cloud.Compute.Images.GetFromFamily(project, family).Do()
+		if err != nil {
+			return nil, fmt.Errorf("error resolving image family %q in project %q: %v", family, project, err)
+		}
+		return image, nil
+	}
+
+	image, err := cloud.Compute.Images.Get(project, name).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving image %q in project %q: %v", name, project, err)
+	}
+	return image, nil
+}
@@ -0,0 +1,28 @@
+package gcetasks
+
+import "testing"
+
+func TestCanonicalizeImageSpec(t *testing.T) {
+	grid := []struct {
+		defaultProject string
+		nameSpec       string
+		project        string
+		name           string
+	}{
+		{"my-default-project", "my-image", "my-default-project", "my-image"},
+		{"my-default-project", "other-project/my-image", "other-project", "my-image"},
+		{"my-default-project", "family/debian-9", "my-default-project", "family/debian-9"},
+		{"my-default-project", "other-project/family/my-family", "other-project", "family/my-family"},
+		{"my-default-project", "debian", "debian-cloud", "family/debian-9"},
+		{"my-default-project", "ubuntu", "ubuntu-os-cloud", "family/ubuntu-1604-lts"},
+		{"my-default-project", "debian/debian-9-stretch-v20180404", "debian-cloud", "debian-9-stretch-v20180404"},
+	}
+
+	for _, g := range grid {
+		project, name := canonicalizeImageSpec(g.defaultProject, g.nameSpec)
+		if project != g.project || name != g.name {
+			t.Errorf("canonicalizeImageSpec(%q, %q) = (%q, %q), want (%q, %q)",
+				g.defaultProject, g.nameSpec, project, name, g.project, g.name)
+		}
+	}
+}
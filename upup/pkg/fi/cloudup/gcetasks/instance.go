@@ -1,6 +1,7 @@
 package gcetasks
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/golang/glog"
@@ -9,24 +10,29 @@ import (
 	"k8s.io/kops/upup/pkg/fi/cloudup/gce"
 	"k8s.io/kops/upup/pkg/fi/cloudup/terraform"
 	"reflect"
-	"strings"
-	"time"
 )
 
 var scopeAliases map[string]string
 
+// scopeShortForms is the inverse of scopeAliases, keyed by the long OAuth
+// scope URL. It's built explicitly in init() (rather than by
+// reverse-scanning scopeAliases on every lookup) because a couple of
+// short forms are aliases of each other and share the same long URL;
+// scopeToShortForm must return one deterministic short form per URL,
+// not depend on Go's randomized map iteration order.
+var scopeShortForms map[string]string
+
 //go:generate fitask -type=Instance
 type Instance struct {
 	Name        *string
-	Network     *Network
 	Tags        []string
 	Preemptible *bool
 	Image       *string
 	Disks       map[string]*PersistentDisk
 
 	CanIPForward *bool
-	IPAddress    *IPAddress
-	Subnet       *Subnet
+
+	NetworkInterfaces []*NetworkInterface
 
 	Scopes []string
 
@@ -35,6 +41,7 @@ type Instance struct {
 	MachineType *string
 
 	metadataFingerprint string
+	tagFingerprint      string
 }
 
 var _ fi.CompareWithID = &Instance{}
@@ -59,6 +66,7 @@ func (e *Instance) Find(c *fi.Context) (*Instance, error) {
 	for _, tag := range r.Tags.Items {
 		actual.Tags = append(actual.Tags, tag)
 	}
+	actual.tagFingerprint = r.Tags.Fingerprint
 	actual.Zone = fi.String(lastComponent(r.Zone))
 	actual.MachineType = fi.String(lastComponent(r.MachineType))
 	actual.CanIPForward = &r.CanIpForward
@@ -66,28 +74,54 @@ func (e *Instance) Find(c *fi.Context) (*Instance, error) {
 	if r.Scheduling != nil {
 		actual.Preemptible = &r.Scheduling.Preemptible
 	}
-	if len(r.NetworkInterfaces) != 0 {
-		ni := r.NetworkInterfaces[0]
-		actual.Network = &Network{Name: fi.String(lastComponent(ni.Network))}
+	for _, ni := range r.NetworkInterfaces {
+		actualNI := &NetworkInterface{
+			Network: &Network{Name: fi.String(lastComponent(ni.Network))},
+		}
+		if ni.Subnetwork != "" {
+			actualNI.Subnet = &Subnet{Name: fi.String(lastComponent(ni.Subnetwork))}
+		}
 		if len(ni.AccessConfigs) != 0 {
 			ac := ni.AccessConfigs[0]
+			actualNI.AccessConfig = ac.Type
 			if ac.NatIP != "" {
 				addr, err := cloud.Compute.Addresses.List(cloud.Project, cloud.Region).Filter("address eq " + ac.NatIP).Do()
 				if err != nil {
 					return nil, fmt.Errorf("error querying for address %q: %v", ac.NatIP, err)
 				} else if len(addr.Items) != 0 {
-					actual.IPAddress = &IPAddress{Name: &addr.Items[0].Name}
+					actualNI.IPAddress = &IPAddress{Name: &addr.Items[0].Name}
 				} else {
 					return nil, fmt.Errorf("address not found %q: %v", ac.NatIP, err)
 				}
 			}
 		}
+		if len(ni.AliasIpRanges) != 0 {
+			actualNI.AliasIPRanges = make(map[string]string)
+			for _, air := range ni.AliasIpRanges {
+				actualNI.AliasIPRanges[air.SubnetworkRangeName] = air.IpCidrRange
+			}
+		}
+		actual.NetworkInterfaces = append(actual.NetworkInterfaces, actualNI)
 	}
 
 	for _, serviceAccount := range r.ServiceAccounts {
 		for _, scope := range serviceAccount.Scopes {
-			actual.Scopes = append(actual.Scopes, scopeToShortForm(scope))
+			actual.Scopes = append(actual.Scopes, canonicalizeServiceScope(scope))
+		}
+	}
+
+	// Unlike every other field above, this rewrites e (the desired state)
+	// rather than actual: e.Scopes is a value the caller built from the
+	// cluster spec and nothing else reads it before the delta comparison
+	// in Run, so normalizing it here to the same short form actual.Scopes
+	// uses is safe, and it's the only way to stop "compute-rw" and its
+	// long OAuth URL form from diffing as a change against each other.
+	if e.Scopes != nil {
+		var canonicalScopes []string
+		for _, s := range e.Scopes {
+			canonicalScopes = append(canonicalScopes, canonicalizeServiceScope(s))
 		}
+		e.Scopes = canonicalScopes
 	}
 
 	actual.Disks = make(map[string]*PersistentDisk)
@@ -140,38 +174,65 @@ func (e *Instance) Run(c *fi.Context) error {
 }
 
 func (_ *Instance) CheckChanges(a, e, changes *Instance) error {
+	if a != nil {
+		// These fields can only be set at creation time. Tags, preemptible
+		// scheduling, machine type, service account scopes and metadata are
+		// reconciled in place by RenderGCE; a change to any other field
+		// (e.g. Image, Disks, CanIPForward) is rejected there instead.
+		if changes.Zone != nil {
+			return fmt.Errorf("cannot change Zone of existing instance %q", fi.StringValue(e.Name))
+		}
+		if changes.NetworkInterfaces != nil {
+			return fmt.Errorf("cannot change NetworkInterfaces of existing instance %q", fi.StringValue(e.Name))
+		}
+	}
 	return nil
 }
 
 func expandScopeAlias(s string) string {
-	switch s {
-	case "storage-ro":
-		s = "https://www.googleapis.com/auth/devstorage.read_only"
-	case "storage-rw":
-		s = "https://www.googleapis.com/auth/devstorage.read_write"
-	case "compute-ro":
-		s = "https://www.googleapis.com/auth/compute.read_only"
-	case "compute-rw":
-		s = "https://www.googleapis.com/auth/compute"
-	case "monitoring":
-		s = "https://www.googleapis.com/auth/monitoring"
-	case "monitoring-write":
-		s = "https://www.googleapis.com/auth/monitoring.write"
-	case "logging-write":
-		s = "https://www.googleapis.com/auth/logging.write"
-	}
-	return s
+	return scopeToLongForm(s)
 }
 
 func init() {
+	// Short forms match `gcloud compute instances create --scopes` exactly,
+	// so a scope written either way round-trips through scopeToShortForm.
 	scopeAliases = map[string]string{
-		"storage-ro":       "https://www.googleapis.com/auth/devstorage.read_only",
-		"storage-rw":       "https://www.googleapis.com/auth/devstorage.read_write",
-		"compute-ro":       "https://www.googleapis.com/auth/compute.read_only",
-		"compute-rw":       "https://www.googleapis.com/auth/compute",
-		"monitoring":       "https://www.googleapis.com/auth/monitoring",
-		"monitoring-write": "https://www.googleapis.com/auth/monitoring.write",
-		"logging-write":    "https://www.googleapis.com/auth/logging.write",
+		"storage-ro":          "https://www.googleapis.com/auth/devstorage.read_only",
+		"storage-rw":          "https://www.googleapis.com/auth/devstorage.read_write",
+		"compute-ro":          "https://www.googleapis.com/auth/compute.read_only",
+		"compute-rw":          "https://www.googleapis.com/auth/compute",
+		"monitoring":          "https://www.googleapis.com/auth/monitoring",
+		"monitoring-write":    "https://www.googleapis.com/auth/monitoring.write",
+		"logging-write":       "https://www.googleapis.com/auth/logging.write",
+		"cloud-platform":      "https://www.googleapis.com/auth/cloud-platform",
+		"service-control":     "https://www.googleapis.com/auth/servicecontrol",
+		"service-management":  "https://www.googleapis.com/auth/service.management",
+		"pubsub":              "https://www.googleapis.com/auth/pubsub",
+		"bigquery":            "https://www.googleapis.com/auth/bigquery",
+		"datastore":           "https://www.googleapis.com/auth/datastore",
+		"taskqueue":           "https://www.googleapis.com/auth/taskqueue",
+		"useraccounts-ro":     "https://www.googleapis.com/auth/cloud.useraccounts.readonly",
+		"useraccounts-rw":     "https://www.googleapis.com/auth/cloud.useraccounts",
+		"sql":                 "https://www.googleapis.com/auth/sqlservice",
+		"sql-admin":           "https://www.googleapis.com/auth/sqlservice.admin",
+		"source-read-only":    "https://www.googleapis.com/auth/source.read_only",
+		"source-read-write":   "https://www.googleapis.com/auth/source.read_write",
+		"source-full-control": "https://www.googleapis.com/auth/source.full_control",
+		"trace":               "https://www.googleapis.com/auth/trace.append",
+		"userinfo-email":      "https://www.googleapis.com/auth/userinfo.email",
+		"cloud-source-repos":  "https://www.googleapis.com/auth/source.full_control",
+	}
+
+	// "cloud-source-repos" is just an older alias for the same scope as
+	// "source-full-control"; skip it here so the scope URL they share
+	// canonicalizes to a single short form, "source-full-control", rather
+	// than an arbitrary one of the two.
+	scopeShortForms = make(map[string]string, len(scopeAliases))
+	for short, long := range scopeAliases {
+		if short == "cloud-source-repos" {
+			continue
+		}
+		scopeShortForms[long] = short
 	}
 }
 
@@ -184,15 +245,21 @@ func scopeToLongForm(s string) string {
 }
 
 func scopeToShortForm(s string) string {
-	for k, v := range scopeAliases {
-		if v == s {
-			return k
-		}
+	if short, found := scopeShortForms[s]; found {
+		return short
 	}
 	return s
 }
 
-func (e *Instance) mapToGCE(project string, ipAddressResolver func(*IPAddress) (*string, error)) (*compute.Instance, error) {
+// canonicalizeServiceScope normalizes a scope - whether given as a short
+// alias (e.g. "compute-rw") or the full OAuth scope URL - to its short
+// form, so scopes can be compared irrespective of which form was used in
+// the cluster spec.
+func canonicalizeServiceScope(s string) string {
+	return scopeToShortForm(scopeToLongForm(s))
+}
+
+func (e *Instance) mapToGCE(project string, ipAddressResolver func(*IPAddress) (*string, error), imageResolver func(string) (string, error)) (*compute.Instance, error) {
 	zone := *e.Zone
 
 	var scheduling *compute.Scheduling
@@ -210,10 +277,15 @@ func (e *Instance) mapToGCE(project string, ipAddressResolver func(*IPAddress) (
 		}
 	}
 
+	sourceImage, err := imageResolver(*e.Image)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving image %q: %v", *e.Image, err)
+	}
+
 	var disks []*compute.AttachedDisk
 	disks = append(disks, &compute.AttachedDisk{
 		InitializeParams: &compute.AttachedDiskInitializeParams{
-			SourceImage: BuildImageURL(project, *e.Image),
+			SourceImage: sourceImage,
 		},
 		Boot:       true,
 		DeviceName: "persistent-disks-0",
@@ -240,24 +312,39 @@ func (e *Instance) mapToGCE(project string, ipAddressResolver func(*IPAddress) (
 	}
 
 	var networkInterfaces []*compute.NetworkInterface
-	if e.IPAddress != nil {
-		addr, err := ipAddressResolver(e.IPAddress)
-		if err != nil {
-			return nil, fmt.Errorf("unable to resolve IP for instance: %v", err)
+	for _, ni := range e.NetworkInterfaces {
+		networkInterface := &compute.NetworkInterface{
+			Network: ni.Network.URL(project),
 		}
-		if addr == nil {
-			return nil, fmt.Errorf("instance IP address has not yet been created")
+		if ni.Subnet != nil {
+			networkInterface.Subnetwork = *ni.Subnet.Name
 		}
-		networkInterface := &compute.NetworkInterface{
-			AccessConfigs: []*compute.AccessConfig{{
+
+		if ni.IPAddress != nil {
+			addr, err := ipAddressResolver(ni.IPAddress)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve IP for instance: %v", err)
+			}
+			if addr == nil {
+				return nil, fmt.Errorf("instance IP address has not yet been created")
+			}
+			accessConfigType := ni.AccessConfig
+			if accessConfigType == "" {
+				accessConfigType = "ONE_TO_ONE_NAT"
+			}
+			networkInterface.AccessConfigs = []*compute.AccessConfig{{
 				NatIP: *addr,
-				Type:  "ONE_TO_ONE_NAT",
-			}},
-			Network: e.Network.URL(project),
+				Type:  accessConfigType,
+			}}
 		}
-		if e.Subnet != nil {
-			networkInterface.Subnetwork = *e.Subnet.Name
+
+		for rangeName, cidr := range ni.AliasIPRanges {
+			networkInterface.AliasIpRanges = append(networkInterface.AliasIpRanges, &compute.AliasIpRange{
+				SubnetworkRangeName: rangeName,
+				IpCidrRange:         cidr,
+			})
 		}
+
 		networkInterfaces = append(networkInterfaces, networkInterface)
 	}
 
@@ -326,7 +413,15 @@ func (_ *Instance) RenderGCE(t *gce.GCEAPITarget, a, e, changes *Instance) error
 		return ip.Address, nil
 	}
 
-	i, err := e.mapToGCE(project, ipAddressResolver)
+	imageResolver := func(nameSpec string) (string, error) {
+		image, err := ResolveImage(cloud, nameSpec)
+		if err != nil {
+			return "", err
+		}
+		return image.SelfLink, nil
+	}
+
+	i, err := e.mapToGCE(project, ipAddressResolver, imageResolver)
 	if err != nil {
 		return err
 	}
@@ -356,71 +451,147 @@ func (_ *Instance) RenderGCE(t *gce.GCEAPITarget, a, e, changes *Instance) error
 			changes.Metadata = nil
 		}
 
-		if !changes.isZero() {
-			glog.Errorf("Cannot apply changes to Instance: %v", changes)
-			return fmt.Errorf("Cannot apply changes to Instance: %v", changes)
-		}
-	}
+		if changes.Tags != nil {
+			glog.V(2).Infof("Updating instance tags on %q", i.Name)
 
-	return nil
-}
+			// i.Tags is nil when e.Tags is nil (mapToGCE only allocates it
+			// when the desired spec sets tags), unlike i.Metadata which is
+			// always a non-nil struct - so clearing a previously-applied
+			// tag list means sending an empty Items rather than dereferencing
+			// a nil i.Tags.
+			tags := &compute.Tags{
+				Fingerprint: a.tagFingerprint,
+			}
+			if i.Tags != nil {
+				tags.Items = i.Tags.Items
+			}
 
-func waitCompletion(c *compute.Service, project string, op *compute.Operation) error {
-	zone := lastComponent(op.Zone)
-	var status *compute.Operation
-	for {
-		var err error
-		status, err = c.ZoneOperations.Get(project, zone, op.Name).Do()
-		if err != nil {
-			return fmt.Errorf("error fetching operation status: %v", err)
-		}
-		done := false
-		switch status.Status {
-		case "DONE":
-			done = true
-		case "PENDING", "RUNNING":
-			glog.V(4).Infof("operation status=%v", status.Status)
-		}
+			op, err := cloud.Compute.Instances.SetTags(project, zone, i.Name, tags).Do()
+			if err != nil {
+				return fmt.Errorf("error setting tags on instance: %v", err)
+			}
+
+			if err := waitCompletion(cloud.Compute, project, op); err != nil {
+				return fmt.Errorf("error setting tags on instance: %v", err)
+			}
 
-		if done {
-			break
+			changes.Tags = nil
 		}
 
-		// TODO: Exponential backoff or similar
-		time.Sleep(1 * time.Second)
-	}
+		// Scheduling, machine type and service-account scopes can only be
+		// changed while the instance is stopped. Once the stop has completed,
+		// restarting it is attempted on every exit path out of this block -
+		// including if one of the updates below fails - via the deferred
+		// Start; if the stop itself fails, no restart is attempted. A transient
+		// error applying a single field doesn't strand the instance
+		// stopped until some later reconcile happens to succeed.
+		if changes.Preemptible != nil || changes.MachineType != nil || changes.Scopes != nil {
+			if err := func() (rErr error) {
+				glog.V(2).Infof("Stopping instance %q to apply changes", i.Name)
+				op, err := cloud.Compute.Instances.Stop(project, zone, i.Name).Do()
+				if err != nil {
+					return fmt.Errorf("error stopping instance: %v", err)
+				}
+				if err := waitCompletion(cloud.Compute, project, op); err != nil {
+					return fmt.Errorf("error stopping instance: %v", err)
+				}
 
-	if status.Error != nil {
-		for _, e := range status.Error.Errors {
-			glog.Warningf("operation failed with error: %v", e)
-		}
+				defer func() {
+					glog.V(2).Infof("Starting instance %q", i.Name)
+					startOp, startErr := cloud.Compute.Instances.Start(project, zone, i.Name).Do()
+					if startErr == nil {
+						startErr = waitCompletion(cloud.Compute, project, startOp)
+					}
+					if startErr == nil {
+						return
+					}
+					startErr = fmt.Errorf("error starting instance after applying changes: %v", startErr)
+					if rErr == nil {
+						rErr = startErr
+					} else {
+						glog.Warningf("instance %q also failed to restart: %v", i.Name, startErr)
+					}
+				}()
+
+				if changes.Preemptible != nil {
+					glog.V(2).Infof("Updating instance scheduling on %q", i.Name)
+
+					op, err := cloud.Compute.Instances.SetScheduling(project, zone, i.Name, i.Scheduling).Do()
+					if err != nil {
+						return fmt.Errorf("error setting scheduling on instance: %v", err)
+					}
+					if err := waitCompletion(cloud.Compute, project, op); err != nil {
+						return fmt.Errorf("error setting scheduling on instance: %v", err)
+					}
+
+					changes.Preemptible = nil
+				}
 
-		return fmt.Errorf("operation failed: %v", status.Error.Errors[0].Message)
-	}
+				if changes.MachineType != nil {
+					glog.V(2).Infof("Updating instance machine type on %q", i.Name)
 
-	if status.Warnings != nil {
-		glog.Warningf("operation completed with warnings: %v", status.Warnings)
+					op, err := cloud.Compute.Instances.SetMachineType(project, zone, i.Name, &compute.InstancesSetMachineTypeRequest{
+						MachineType: i.MachineType,
+					}).Do()
+					if err != nil {
+						return fmt.Errorf("error setting machine type on instance: %v", err)
+					}
+					if err := waitCompletion(cloud.Compute, project, op); err != nil {
+						return fmt.Errorf("error setting machine type on instance: %v", err)
+					}
+
+					changes.MachineType = nil
+				}
+
+				if changes.Scopes != nil {
+					glog.V(2).Infof("Updating instance service account scopes on %q", i.Name)
+
+					serviceAccount := &compute.ServiceAccount{Email: "default"}
+					if len(i.ServiceAccounts) != 0 {
+						serviceAccount = i.ServiceAccounts[0]
+					}
+
+					op, err := cloud.Compute.Instances.SetServiceAccount(project, zone, i.Name, &compute.InstancesSetServiceAccountRequest{
+						Email:  serviceAccount.Email,
+						Scopes: serviceAccount.Scopes,
+					}).Do()
+					if err != nil {
+						return fmt.Errorf("error setting service account scopes on instance: %v", err)
+					}
+					if err := waitCompletion(cloud.Compute, project, op); err != nil {
+						return fmt.Errorf("error setting service account scopes on instance: %v", err)
+					}
+
+					changes.Scopes = nil
+				}
+
+				return nil
+			}(); err != nil {
+				return err
+			}
+		}
+
+		if !changes.isZero() {
+			glog.Errorf("Cannot apply changes to Instance: %v", changes)
+			return fmt.Errorf("Cannot apply changes to Instance: %v", changes)
+		}
 	}
 
 	return nil
 }
 
+// waitCompletion waits for a GCE operation to complete, regardless of
+// whether it is zone-, region- or project-scoped.
+func waitCompletion(c *compute.Service, project string, op *compute.Operation) error {
+	return gce.NewOperationWaiter(c, project).Wait(context.Background(), op)
+}
+
 func BuildMachineTypeURL(project, zone, name string) string {
 	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/machineTypes/%s", project, zone, name)
 }
 
 func BuildImageURL(defaultProject, nameSpec string) string {
-	tokens := strings.Split(nameSpec, "/")
-	var project, name string
-	if len(tokens) == 2 {
-		project = tokens[0]
-		name = tokens[1]
-	} else if len(tokens) == 1 {
-		project = defaultProject
-		name = tokens[0]
-	} else {
-		glog.Exitf("Cannot parse image spec: %q", nameSpec)
-	}
+	project, name := canonicalizeImageSpec(defaultProject, nameSpec)
 
 	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/images/%s", project, name)
 }
@@ -446,7 +617,14 @@ func (_ *Instance) RenderTerraform(t *terraform.TerraformTarget, a, e, changes *
 		return &tf, nil
 	}
 
-	i, err := e.mapToGCE(project, ipAddressResolver)
+	// Terraform renders a plan offline, so we don't resolve image families
+	// against the API here; BuildImageURL still expands OS aliases like
+	// "ubuntu" using the same alias table as ResolveImage.
+	imageResolver := func(nameSpec string) (string, error) {
+		return BuildImageURL(project, nameSpec), nil
+	}
+
+	i, err := e.mapToGCE(project, ipAddressResolver, imageResolver)
 	if err != nil {
 		return err
 	}
@@ -456,7 +634,11 @@ func (_ *Instance) RenderTerraform(t *terraform.TerraformTarget, a, e, changes *
 		CanIPForward: i.CanIpForward,
 		MachineType:  lastComponent(i.MachineType),
 		Zone:         i.Zone,
-		Tags:         i.Tags.Items,
+	}
+	// i.Tags is nil whenever e.Tags is nil (mapToGCE only allocates it when
+	// the desired spec sets tags), same as the SetTags path in RenderGCE.
+	if i.Tags != nil {
+		tf.Tags = i.Tags.Items
 	}
 
 	// TF requires zone
@@ -484,7 +666,7 @@ func (_ *Instance) RenderTerraform(t *terraform.TerraformTarget, a, e, changes *
 		tf.Disks = append(tf.Disks, tfd)
 	}
 
-	tf.AddNetworks(e.Network, e.Subnet, i.NetworkInterfaces)
+	tf.AddNetworkInterfaces(e.NetworkInterfaces, i.NetworkInterfaces)
 
 	tf.AddMetadata(i.Metadata)
 
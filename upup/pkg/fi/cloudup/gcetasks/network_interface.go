@@ -0,0 +1,25 @@
+package gcetasks
+
+// NetworkInterface describes a single network interface to attach to an
+// Instance. Unlike PersistentDisk or IPAddress, it is not itself a
+// fi.Task - it's a plain value embedded in Instance.NetworkInterfaces,
+// with its own Network/Subnet/IPAddress and alias IP ranges so an
+// instance can have more than one NIC.
+type NetworkInterface struct {
+	Network *Network
+	Subnet  *Subnet
+
+	// IPAddress is the static external IP to assign to this interface, if
+	// any. Leave nil for an interface with no external access config.
+	IPAddress *IPAddress
+
+	// AccessConfig is the type of external access config to create for
+	// this interface (e.g. "ONE_TO_ONE_NAT"). It is only meaningful when
+	// IPAddress is set; leave empty for an internal-only interface.
+	AccessConfig string
+
+	// AliasIPRanges maps a subnet secondary range name to the CIDR it
+	// should expose as an alias IP range on this interface. This is how
+	// GKE-style pod-CIDR-per-node networking is expressed on GCE.
+	AliasIPRanges map[string]string
+}
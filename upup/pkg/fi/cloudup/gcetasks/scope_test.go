@@ -0,0 +1,65 @@
+package gcetasks
+
+import "testing"
+
+// TestCanonicalizeServiceScope round-trips every short alias through
+// canonicalizeServiceScope and checks the long form it aliases resolves
+// back to it too, except "cloud-source-repos" which deliberately
+// canonicalizes to its sibling "source-full-control" (see init()).
+func TestCanonicalizeServiceScope(t *testing.T) {
+	for short, long := range scopeAliases {
+		want := short
+		if short == "cloud-source-repos" {
+			want = "source-full-control"
+		}
+
+		if got := canonicalizeServiceScope(short); got != want {
+			t.Errorf("canonicalizeServiceScope(%q) = %q, want %q", short, got, want)
+		}
+		if got := canonicalizeServiceScope(long); got != want {
+			t.Errorf("canonicalizeServiceScope(%q) = %q, want %q", long, got, want)
+		}
+	}
+}
+
+// TestCanonicalizeServiceScopeUnknown checks that a scope outside
+// scopeAliases (already a long form kops doesn't know an alias for, or
+// just an opaque string) passes through unchanged rather than erroring.
+func TestCanonicalizeServiceScopeUnknown(t *testing.T) {
+	unknown := "https://www.googleapis.com/auth/some.unlisted.scope"
+	if got := canonicalizeServiceScope(unknown); got != unknown {
+		t.Errorf("canonicalizeServiceScope(%q) = %q, want %q", unknown, got, unknown)
+	}
+}
+
+// TestCanonicalizeServiceScopeCollapsesDuplicateAliases locks in that
+// "cloud-source-repos" and "source-full-control", which share the same
+// long OAuth URL, always canonicalize to the same short form. This is
+// the exact case that was non-deterministic before scopeShortForms was
+// introduced to replace a reverse scan over scopeAliases.
+func TestCanonicalizeServiceScopeCollapsesDuplicateAliases(t *testing.T) {
+	got := canonicalizeServiceScope("cloud-source-repos")
+	want := canonicalizeServiceScope("source-full-control")
+	if got != want {
+		t.Errorf("canonicalizeServiceScope(%q) = %q, want it to match canonicalizeServiceScope(%q) = %q",
+			"cloud-source-repos", got, "source-full-control", want)
+	}
+	if got != "source-full-control" {
+		t.Errorf("canonicalizeServiceScope(%q) = %q, want %q", "cloud-source-repos", got, "source-full-control")
+	}
+}
+
+// TestScopeToShortFormDeterministic calls scopeToShortForm on the shared
+// long URL many times and requires the exact same answer every time,
+// guarding against the randomized Go map iteration order that caused
+// this to flap between "cloud-source-repos" and "source-full-control".
+func TestScopeToShortFormDeterministic(t *testing.T) {
+	long := scopeAliases["source-full-control"]
+
+	want := scopeToShortForm(long)
+	for i := 0; i < 100; i++ {
+		if got := scopeToShortForm(long); got != want {
+			t.Fatalf("scopeToShortForm(%q) = %q on iteration %d, want %q", long, got, i, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package gcetasks
+
+import (
+	"google.golang.org/api/compute/v1"
+)
+
+// terraformInstanceTemplate is the shape RenderTerraform fills in and
+// hands to TerraformTarget.RenderResource to emit a
+// "google_compute_instance" resource block.
+type terraformInstanceTemplate struct {
+	Name         string
+	CanIPForward bool
+	MachineType  string
+	Zone         string
+	Tags         []string
+
+	Disks []*terraformAttachedDisk
+
+	NetworkInterfaces []*terraformNetworkInterface
+
+	ServiceAccount *terraformServiceAccount
+
+	Metadata              map[string]string
+	MetadataStartupScript string
+
+	Scheduling *terraformScheduling
+}
+
+type terraformAttachedDisk struct {
+	AutoDelete bool
+	Scratch    bool
+	DeviceName string
+	Disk       string
+	Image      string
+	Type       string
+	Size       int64
+}
+
+type terraformScheduling struct {
+	AutomaticRestart  bool
+	OnHostMaintenance string
+	Preemptible       bool
+}
+
+type terraformServiceAccount struct {
+	Email  string
+	Scopes []string
+}
+
+// terraformNetworkInterface mirrors one entry of an Instance's
+// NetworkInterfaces in the "network_interface" block of a
+// google_compute_instance resource.
+type terraformNetworkInterface struct {
+	Network      string
+	Subnetwork   string
+	AccessConfig []*terraformAccessConfig
+	AliasIPRange []*terraformAliasIPRange
+}
+
+type terraformAccessConfig struct {
+	NatIP string
+}
+
+type terraformAliasIPRange struct {
+	SubnetworkRangeName string
+	IPCIDRRange         string
+}
+
+// AddServiceAccounts copies the (at most one) service account GCE attaches
+// to an instance into the terraform resource.
+func (tf *terraformInstanceTemplate) AddServiceAccounts(serviceAccounts []*compute.ServiceAccount) {
+	if len(serviceAccounts) == 0 {
+		return
+	}
+
+	sa := serviceAccounts[0]
+	tf.ServiceAccount = &terraformServiceAccount{
+		Email:  sa.Email,
+		Scopes: sa.Scopes,
+	}
+}
+
+// AddMetadata copies instance metadata into the terraform resource's
+// metadata map.
+func (tf *terraformInstanceTemplate) AddMetadata(metadata *compute.Metadata) {
+	if metadata == nil {
+		return
+	}
+
+	tf.Metadata = make(map[string]string)
+	for _, item := range metadata.Items {
+		if item.Value == nil {
+			continue
+		}
+		tf.Metadata[item.Key] = *item.Value
+	}
+}
+
+// AddNetworkInterfaces renders each configured NetworkInterface, paired
+// with its resolved compute.NetworkInterface, into the terraform
+// "network_interface" blocks for the instance. It replaces the old
+// single-interface AddNetworks now that an Instance can have more than
+// one NIC.
+func (tf *terraformInstanceTemplate) AddNetworkInterfaces(expected []*NetworkInterface, rendered []*compute.NetworkInterface) {
+	for idx, ni := range rendered {
+		tfni := &terraformNetworkInterface{
+			Network:    ni.Network,
+			Subnetwork: ni.Subnetwork,
+		}
+
+		// Prefer a terraform resource reference over the resolved URL, so
+		// the plan depends on the google_compute_network/subnetwork
+		// resources rather than a hardcoded link.
+		if idx < len(expected) {
+			if network := expected[idx].Network; network != nil && network.Name != nil {
+				tfni.Network = "${google_compute_network." + *network.Name + ".name}"
+			}
+			if subnet := expected[idx].Subnet; subnet != nil && subnet.Name != nil {
+				tfni.Subnetwork = "${google_compute_subnetwork." + *subnet.Name + ".name}"
+			}
+		}
+
+		for _, ac := range ni.AccessConfigs {
+			tfni.AccessConfig = append(tfni.AccessConfig, &terraformAccessConfig{
+				NatIP: ac.NatIP,
+			})
+		}
+
+		for _, air := range ni.AliasIpRanges {
+			tfni.AliasIPRange = append(tfni.AliasIPRange, &terraformAliasIPRange{
+				SubnetworkRangeName: air.SubnetworkRangeName,
+				IPCIDRRange:         air.IpCidrRange,
+			})
+		}
+
+		tf.NetworkInterfaces = append(tf.NetworkInterfaces, tfni)
+	}
+}